@@ -0,0 +1,208 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/Vertamedia/chproxy/log"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// activeScopes is a process-wide count of scopes currently in flight,
+// independent of the per-user/per-cluster-user limits. It backs the
+// max_concurrent_scopes watermark below.
+var activeScopes uint32
+
+// maxConcurrentScopes is the process-wide watermark above which new scopes
+// are rejected with HTTP 503 instead of being admitted, so an upstream load
+// balancer can shed load onto a less busy replica. Zero disables the check.
+var maxConcurrentScopes uint32
+
+// errTooManyScopes is returned by admitScope when the process is above
+// maxConcurrentScopes. The caller maps it onto a 503 with Retry-After.
+var errTooManyScopes = fmt.Errorf("too many concurrent scopes")
+
+// retryAfter is the value chproxy suggests to clients rejected by
+// admitScope or a draining host.
+const retryAfter = 5 * time.Second
+
+// admitScope reserves a slot in the process-wide scope watermark. Callers
+// must call releaseScope once the scope finishes, mirroring scope.inc/dec.
+func admitScope() error {
+	if maxConcurrentScopes == 0 {
+		atomic.AddUint32(&activeScopes, 1)
+		return nil
+	}
+	n := atomic.AddUint32(&activeScopes, 1)
+	if n > maxConcurrentScopes {
+		atomic.AddUint32(&activeScopes, ^uint32(0))
+		scopesRejected.Inc()
+		return errTooManyScopes
+	}
+	return nil
+}
+
+func releaseScope() {
+	atomic.AddUint32(&activeScopes, ^uint32(0))
+}
+
+// Drain stops host from accepting new scopes and waits for scopes already
+// running against it to finish, up to timeout. Stragglers still running
+// once the timeout elapses are killed via killQuery.
+func (h *host) Drain(ctx context.Context, timeout time.Duration) error {
+	atomic.StoreUint32(&h.draining, 1)
+	log.Debugf("draining host %q", h.addr.Host)
+
+	deadline := time.Now().Add(timeout)
+	// Use the same registry the straggler kill below reads, not queryCounter,
+	// which can still be 0 for a scope that's registered but not yet dispatched.
+	for len(h.snapshotScopes()) > 0 {
+		if time.Now().After(deadline) {
+			break
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(50 * time.Millisecond):
+		}
+	}
+
+	stragglers := h.snapshotScopes()
+	for _, s := range stragglers {
+		if err := s.killQuery(); err != nil {
+			log.Errorf("error killing straggler query on drained host %q: %s", h.addr.Host, err)
+			continue
+		}
+		scopesKilled.With(prometheus.Labels{"host": h.addr.Host}).Inc()
+	}
+	scopesDrained.With(prometheus.Labels{"host": h.addr.Host}).Inc()
+	return nil
+}
+
+func (h *host) isDraining() bool {
+	return atomic.LoadUint32(&h.draining) == 1
+}
+
+func (h *host) registerScope(s *scope) {
+	h.scopesMu.Lock()
+	if h.runningScopes == nil {
+		h.runningScopes = make(map[uint32]*scope)
+	}
+	h.runningScopes[s.id] = s
+	h.scopesMu.Unlock()
+}
+
+func (h *host) unregisterScope(id uint32) {
+	h.scopesMu.Lock()
+	delete(h.runningScopes, id)
+	h.scopesMu.Unlock()
+}
+
+func (h *host) snapshotScopes() []*scope {
+	h.scopesMu.Lock()
+	defer h.scopesMu.Unlock()
+	out := make([]*scope, 0, len(h.runningScopes))
+	for _, s := range h.runningScopes {
+		out = append(out, s)
+	}
+	return out
+}
+
+// Drain drains every host in the cluster, e.g. on SIGTERM. timeout bounds
+// how long each host waits for in-flight scopes before killing stragglers.
+func (c *cluster) Drain(ctx context.Context, timeout time.Duration) error {
+	var wg sync.WaitGroup
+	errs := make([]error, len(c.hosts))
+	for i, h := range c.hosts {
+		wg.Add(1)
+		go func(i int, h *host) {
+			defer wg.Done()
+			errs[i] = h.Drain(ctx, timeout)
+		}(i, h)
+	}
+	wg.Wait()
+	for _, err := range errs {
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// DrainHandler is the /drain admin endpoint: POST /drain?cluster=foo&host=bar
+// starts draining a single host, POST /drain?cluster=foo drains every host
+// in that cluster. It's meant to be wired into the admin mux next to the
+// existing /metrics and config-reload handlers.
+func DrainHandler(clusters map[string]*cluster) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		name := r.URL.Query().Get("cluster")
+		c, ok := clusters[name]
+		if !ok {
+			http.Error(w, fmt.Sprintf("unknown cluster %q", name), http.StatusNotFound)
+			return
+		}
+		timeout := 30 * time.Second
+		if v := r.URL.Query().Get("timeout"); v != "" {
+			if d, err := time.ParseDuration(v); err == nil {
+				timeout = d
+			}
+		}
+
+		hostAddr := r.URL.Query().Get("host")
+		if hostAddr == "" {
+			if err := c.Drain(r.Context(), timeout); err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			fmt.Fprintf(w, "draining cluster %q\n", name)
+			return
+		}
+
+		for _, h := range c.hosts {
+			if h.addr.Host == hostAddr {
+				if err := h.Drain(r.Context(), timeout); err != nil {
+					http.Error(w, err.Error(), http.StatusInternalServerError)
+					return
+				}
+				fmt.Fprintf(w, "draining host %q\n", hostAddr)
+				return
+			}
+		}
+		http.Error(w, fmt.Sprintf("unknown host %q in cluster %q", hostAddr, name), http.StatusNotFound)
+	}
+}
+
+// rejectOverloaded writes a 503 with Retry-After for requests bounced by
+// admitScope, so the caller's load balancer can retry elsewhere.
+func rejectOverloaded(w http.ResponseWriter) {
+	w.Header().Set("Retry-After", strconv.Itoa(int(retryAfter.Seconds())))
+	http.Error(w, errTooManyScopes.Error(), http.StatusServiceUnavailable)
+}
+
+var (
+	scopesDrained = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "chproxy_scopes_drained_total",
+		Help: "Number of host drains completed, including those that killed straggler scopes.",
+	}, []string{"host"})
+	scopesKilled = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "chproxy_scopes_killed_total",
+		Help: "Number of straggler scopes killed via KILL QUERY after a drain timeout.",
+	}, []string{"host"})
+	scopesRejected = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "chproxy_scopes_rejected_total",
+		Help: "Number of scopes rejected with 503 because max_concurrent_scopes was exceeded.",
+	})
+)
+
+func init() {
+	prometheus.MustRegister(scopesDrained, scopesKilled, scopesRejected)
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Vertamedia/chproxy/log"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// HealthProbe scores a host's health on a 0..1 scale, where 1 is perfectly
+// healthy and 0 is dead. Scores between the two mark a host as degraded
+// rather than excluded outright -- see (*host).load.
+type HealthProbe interface {
+	Name() string
+	Probe(addr *url.URL) (float64, error)
+}
+
+// SelectOneProbe is the original naive liveness ping: SELECT 1 either
+// succeeds (1.0) or the host is treated as fully dead (0.0).
+type SelectOneProbe struct{}
+
+func (SelectOneProbe) Name() string { return "select_one" }
+
+func (SelectOneProbe) Probe(addr *url.URL) (float64, error) {
+	if err := isHealthy(addr.String()); err != nil {
+		return 0, err
+	}
+	return 1, nil
+}
+
+// ReplicationLagProbe reads system.replicas.absolute_delay and marks a host
+// degraded -- not dead -- once it exceeds MaxLag, down-weighting it in
+// proportion to how far past the threshold it is (score MaxLag/lag). A
+// non-positive MaxLag disables the probe.
+type ReplicationLagProbe struct {
+	MaxLag time.Duration
+}
+
+func (ReplicationLagProbe) Name() string { return "replication_lag" }
+
+func (p ReplicationLagProbe) Probe(addr *url.URL) (float64, error) {
+	out, err := runProbeQuery(addr, "SELECT max(absolute_delay) FROM system.replicas")
+	if err != nil {
+		return 0, err
+	}
+	lagSeconds, err := strconv.ParseFloat(out, 64)
+	if err != nil {
+		return 0, fmt.Errorf("error parsing replication lag %q from %q: %s", out, addr.Host, err)
+	}
+	lag := time.Duration(lagSeconds * float64(time.Second))
+	if lag <= 0 || p.MaxLag <= 0 || lag <= p.MaxLag {
+		return 1, nil
+	}
+	return float64(p.MaxLag) / float64(lag), nil
+}
+
+// QueueDepthProbe reads the size of system.replication_queue and degrades a
+// host proportionally once it exceeds MaxQueueDepth.
+type QueueDepthProbe struct {
+	MaxQueueDepth int
+}
+
+func (QueueDepthProbe) Name() string { return "queue_depth" }
+
+func (p QueueDepthProbe) Probe(addr *url.URL) (float64, error) {
+	out, err := runProbeQuery(addr, "SELECT count() FROM system.replication_queue")
+	if err != nil {
+		return 0, err
+	}
+	depth, err := strconv.Atoi(out)
+	if err != nil {
+		return 0, fmt.Errorf("error parsing replication queue depth %q from %q: %s", out, addr.Host, err)
+	}
+	if depth <= p.MaxQueueDepth || p.MaxQueueDepth <= 0 {
+		return 1, nil
+	}
+	return float64(p.MaxQueueDepth) / float64(depth), nil
+}
+
+// TCPPortProbe is a bare TCP dial, useful as a cheap last line of defense
+// when the HTTP probes above can't run (e.g. interface is up but the
+// ClickHouse process itself is wedged).
+type TCPPortProbe struct {
+	Timeout time.Duration
+}
+
+func (TCPPortProbe) Name() string { return "tcp_port" }
+
+func (p TCPPortProbe) Probe(addr *url.URL) (float64, error) {
+	timeout := p.Timeout
+	if timeout <= 0 {
+		timeout = time.Second
+	}
+	conn, err := net.DialTimeout("tcp", addr.Host, timeout)
+	if err != nil {
+		return 0, err
+	}
+	conn.Close()
+	return 1, nil
+}
+
+// runProbeQuery executes query against addr the same way the proxy itself
+// talks to ClickHouse and returns the trimmed response body.
+func runProbeQuery(addr *url.URL, query string) (string, error) {
+	u := *addr
+	q := make(url.Values)
+	q.Set("query", query)
+	u.RawQuery = q.Encode()
+
+	resp, err := http.Get(u.String())
+	if err != nil {
+		return "", fmt.Errorf("error while probing %q: %s", addr.Host, err)
+	}
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return "", fmt.Errorf("error reading probe response from %q: %s", addr.Host, err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("unexpected status code %d from %q: %q", resp.StatusCode, addr.Host, body)
+	}
+	return strings.TrimSpace(string(body)), nil
+}
+
+// runHealthProbes runs every configured probe against addr and averages
+// their scores. A probe that errors out contributes a score of 0 rather
+// than being skipped, so a single wedged probe can still pull a host down.
+func runHealthProbes(probes []HealthProbe, addr *url.URL, cluster, hostLabel string) float64 {
+	if len(probes) == 0 {
+		probes = []HealthProbe{SelectOneProbe{}}
+	}
+	var sum float64
+	for _, p := range probes {
+		score, err := p.Probe(addr)
+		if err != nil {
+			log.Errorf("error running %q health probe against %q: %s", p.Name(), addr.Host, err)
+		}
+		probeScore.With(prometheus.Labels{"cluster": cluster, "host": hostLabel, "probe": p.Name()}).Set(score)
+		sum += score
+	}
+	return sum / float64(len(probes))
+}
+
+var probeScore = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+	Name: "chproxy_health_probe_score",
+	Help: "Per-probe health score (0..1) last observed for a host.",
+}, []string{"cluster", "host", "probe"})
+
+func init() {
+	prometheus.MustRegister(probeScore)
+}
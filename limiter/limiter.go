@@ -0,0 +1,72 @@
+// Package limiter provides pluggable concurrency limiting for chproxy
+// scopes. A single process behind a load balancer can enforce limits
+// purely locally, but a fleet of replicas needs a shared view of how many
+// requests are in flight for a given user or cluster user -- that's what
+// PeerLimiter is for.
+package limiter
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+)
+
+// Limiter tracks the number of in-flight requests per key (typically
+// "user:<name>" or "clusteruser:<name>") and reports the count after each
+// Take so callers can compare it against their configured maxConcurrentQueries.
+type Limiter interface {
+	// Take reserves a slot for key and returns the number of in-flight
+	// requests for that key after the reservation. It only returns an
+	// error when the reservation could not be made at all, e.g. an owning
+	// peer is unreachable and no local fallback is available.
+	Take(ctx context.Context, key string) (uint32, error)
+	// Release frees a slot previously reserved by Take.
+	Release(key string)
+	// Count reports the current in-flight count for key without taking or
+	// releasing a slot. It's used for host/scheduling decisions that only
+	// need to read the load, e.g. cluster.getHost.
+	Count(key string) uint32
+}
+
+// LocalLimiter counts in-flight requests per key within this process only.
+// It's the direct replacement for the old queryCounter.inc/dec pair and is
+// used standalone on single-replica deployments, or as the fallback path
+// inside PeerLimiter.
+type LocalLimiter struct {
+	mu       sync.Mutex
+	counters map[string]*uint32
+}
+
+// NewLocal returns a Limiter that keeps counters in process memory.
+func NewLocal() *LocalLimiter {
+	return &LocalLimiter{
+		counters: make(map[string]*uint32),
+	}
+}
+
+func (l *LocalLimiter) counter(key string) *uint32 {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	c, ok := l.counters[key]
+	if !ok {
+		c = new(uint32)
+		l.counters[key] = c
+	}
+	return c
+}
+
+// Take implements Limiter. It never blocks and never returns an error --
+// the local counter is always available.
+func (l *LocalLimiter) Take(_ context.Context, key string) (uint32, error) {
+	return atomic.AddUint32(l.counter(key), 1), nil
+}
+
+// Release implements Limiter.
+func (l *LocalLimiter) Release(key string) {
+	atomic.AddUint32(l.counter(key), ^uint32(0))
+}
+
+// Count implements Limiter.
+func (l *LocalLimiter) Count(key string) uint32 {
+	return atomic.LoadUint32(l.counter(key))
+}
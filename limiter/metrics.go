@@ -0,0 +1,18 @@
+package limiter
+
+import "github.com/prometheus/client_golang/prometheus"
+
+var (
+	ownedDecisions = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "chproxy_limiter_owned_total",
+		Help: "Number of Take/Release decisions this peer resolved against its own local counter.",
+	})
+	forwardedDecisions = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "chproxy_limiter_forwarded_total",
+		Help: "Number of Take/Release decisions forwarded to the owning peer.",
+	})
+)
+
+func init() {
+	prometheus.MustRegister(ownedDecisions, forwardedDecisions)
+}
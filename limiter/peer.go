@@ -0,0 +1,312 @@
+package limiter
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"net"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/Vertamedia/chproxy/log"
+)
+
+// TakePath is the HTTP endpoint PeerLimiter uses to forward Take/Release
+// calls to the peer that owns a given key. The admin server that embeds
+// PeerLimiter must route this path to ServeHTTP.
+const TakePath = "/peer-limiter/take"
+
+// rpcRequest/rpcResponse are the wire format exchanged between peers.
+type rpcRequest struct {
+	Key     string `json:"key"`
+	Release bool   `json:"release"`
+	Peek    bool   `json:"peek"`
+}
+
+type rpcResponse struct {
+	Count uint32 `json:"count"`
+	Error string `json:"error,omitempty"`
+}
+
+// ringVnodes is the number of virtual nodes hashed onto the ring per peer.
+// More virtual nodes smooth out the key distribution at the cost of a
+// bigger ring to binary-search; 160 is the usual textbook default.
+const ringVnodes = 160
+
+// hashRing assigns keys to peers using actual consistent hashing (peers are
+// hashed onto a ring via virtual nodes, keys map to the next position
+// clockwise), so that adding or removing a peer only remaps the keys that
+// fell in the changed peer's arcs, not the whole keyspace.
+type hashRing struct {
+	positions []uint32
+	owners    map[uint32]string
+}
+
+func newHashRing(peers []string) *hashRing {
+	r := &hashRing{owners: make(map[uint32]string, len(peers)*ringVnodes)}
+	for _, peer := range peers {
+		for i := 0; i < ringVnodes; i++ {
+			h := hashString(fmt.Sprintf("%s#%d", peer, i))
+			if _, exists := r.owners[h]; exists {
+				continue
+			}
+			r.owners[h] = peer
+			r.positions = append(r.positions, h)
+		}
+	}
+	sort.Slice(r.positions, func(i, j int) bool { return r.positions[i] < r.positions[j] })
+	return r
+}
+
+func (r *hashRing) owner(key string) string {
+	if len(r.positions) == 0 {
+		return ""
+	}
+	h := hashString(key)
+	idx := sort.Search(len(r.positions), func(i int) bool { return r.positions[i] >= h })
+	if idx == len(r.positions) {
+		idx = 0
+	}
+	return r.owners[r.positions[idx]]
+}
+
+func hashString(s string) uint32 {
+	h := fnv.New32a()
+	h.Write([]byte(s))
+	return h.Sum32()
+}
+
+// PeerLimiter shards limit keys across a configured set of chproxy peers via
+// consistent hashing and forwards Take/Release to whichever peer owns a key.
+// The owning peer keeps the authoritative counter; every other peer treats
+// it as a remote call. If the owner can't be reached, PeerLimiter falls back
+// to its own LocalLimiter for up to staleTolerance before starting to fail.
+type PeerLimiter struct {
+	self   string
+	ring   *hashRing
+	local  *LocalLimiter
+	client *http.Client
+
+	staleTolerance time.Duration
+
+	mu          sync.Mutex
+	unreachable map[string]time.Time
+
+	// locMu guards locations, a per-key FIFO queue of where each outstanding
+	// Take actually landed ("" for local), so Release can honor it instead
+	// of re-deriving a possibly different owner from current reachability.
+	locMu     sync.Mutex
+	locations map[string][]string
+}
+
+// NewPeer builds a PeerLimiter. self is this process's own peer address (as
+// it appears in peers), peers is the static mesh membership, and
+// staleTolerance is how long a peer is allowed to keep serving from its
+// local counter after its designated owner stops responding.
+func NewPeer(self string, peers []string, staleTolerance time.Duration) *PeerLimiter {
+	return &PeerLimiter{
+		self:           self,
+		ring:           newHashRing(peers),
+		local:          NewLocal(),
+		client:         &http.Client{Timeout: 2 * time.Second},
+		staleTolerance: staleTolerance,
+		unreachable:    make(map[string]time.Time),
+		locations:      make(map[string][]string),
+	}
+}
+
+// pushLocation records that the most recent Take for key was served by loc
+// ("" for the local counter), so the matching Release can honor it instead
+// of re-deriving a (possibly now different) owner from current reachability.
+func (p *PeerLimiter) pushLocation(key, loc string) {
+	p.locMu.Lock()
+	p.locations[key] = append(p.locations[key], loc)
+	p.locMu.Unlock()
+}
+
+// popLocation removes and returns the location recorded by the oldest
+// outstanding Take for key, or ("", false) if there isn't one -- which can
+// happen if Release is called without a matching Take; callers fall back to
+// re-deriving the owner in that case.
+func (p *PeerLimiter) popLocation(key string) (string, bool) {
+	p.locMu.Lock()
+	defer p.locMu.Unlock()
+	locs := p.locations[key]
+	if len(locs) == 0 {
+		return "", false
+	}
+	loc := locs[0]
+	locs = locs[1:]
+	if len(locs) == 0 {
+		delete(p.locations, key)
+	} else {
+		p.locations[key] = locs
+	}
+	return loc, true
+}
+
+// DiscoverPeers resolves a static list of peer addresses plus, optionally, a
+// DNS SRV record (srvName may be empty to skip the lookup) into the combined
+// peer set PeerLimiter should hash over.
+func DiscoverPeers(static []string, srvName string) ([]string, error) {
+	peers := append([]string(nil), static...)
+	if srvName == "" {
+		return peers, nil
+	}
+	_, addrs, err := net.LookupSRV("", "", srvName)
+	if err != nil {
+		return nil, fmt.Errorf("error resolving SRV record %q: %s", srvName, err)
+	}
+	for _, a := range addrs {
+		peers = append(peers, fmt.Sprintf("%s:%d", a.Target, a.Port))
+	}
+	return peers, nil
+}
+
+func (p *PeerLimiter) Take(ctx context.Context, key string) (uint32, error) {
+	owner := p.ring.owner(key)
+	if owner == "" || owner == p.self || p.recentlyUnreachable(owner) {
+		ownedDecisions.Inc()
+		p.pushLocation(key, "")
+		return p.local.Take(ctx, key)
+	}
+	n, err := p.call(ctx, owner, rpcRequest{Key: key})
+	if err != nil {
+		p.markUnreachable(owner)
+		p.mu.Lock()
+		since := p.unreachable[owner]
+		p.mu.Unlock()
+		if time.Since(since) >= p.staleTolerance {
+			return 0, fmt.Errorf("peer %q unreachable for longer than %s: %s", owner, p.staleTolerance, err)
+		}
+		log.Errorf("limiter: peer %q unreachable, falling back to local counter: %s", owner, err)
+		ownedDecisions.Inc()
+		p.pushLocation(key, "")
+		return p.local.Take(ctx, key)
+	}
+	forwardedDecisions.Inc()
+	p.pushLocation(key, owner)
+	return n, nil
+}
+
+// Release frees the slot taken by the oldest outstanding Take for key, at
+// whichever location actually served it rather than wherever the ring or
+// current reachability say the owner is now.
+func (p *PeerLimiter) Release(key string) {
+	loc, ok := p.popLocation(key)
+	if !ok {
+		// No matching Take on record; fall back to best-effort routing.
+		loc = p.ring.owner(key)
+		if p.recentlyUnreachable(loc) {
+			loc = ""
+		}
+	}
+	if loc == "" || loc == p.self {
+		p.local.Release(key)
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), p.client.Timeout)
+	defer cancel()
+	if _, err := p.call(ctx, loc, rpcRequest{Key: key, Release: true}); err != nil {
+		log.Errorf("limiter: peer %q unreachable while releasing, releasing locally instead: %s", loc, err)
+		p.markUnreachable(loc)
+		p.local.Release(key)
+	}
+}
+
+// Count implements Limiter. It reads the owner's counter without reserving
+// or freeing a slot; on a recently-unreachable owner it falls back to this
+// process's own (possibly stale) local counter rather than blocking.
+func (p *PeerLimiter) Count(key string) uint32 {
+	owner := p.ring.owner(key)
+	if owner == "" || owner == p.self || p.recentlyUnreachable(owner) {
+		return p.local.Count(key)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), p.client.Timeout)
+	defer cancel()
+	n, err := p.call(ctx, owner, rpcRequest{Key: key, Peek: true})
+	if err != nil {
+		p.markUnreachable(owner)
+		return p.local.Count(key)
+	}
+	return n
+}
+
+func (p *PeerLimiter) call(ctx context.Context, peer string, rpc rpcRequest) (uint32, error) {
+	body, err := json.Marshal(rpc)
+	if err != nil {
+		return 0, err
+	}
+	req, err := http.NewRequest("POST", fmt.Sprintf("http://%s%s", peer, TakePath), bytes.NewReader(body))
+	if err != nil {
+		return 0, err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+
+	var out rpcResponse
+	if err := json.NewDecoder(resp.Body).Decode(&out); err != nil {
+		return 0, fmt.Errorf("error decoding response from peer %q: %s", peer, err)
+	}
+	if out.Error != "" {
+		return 0, fmt.Errorf("peer %q returned error: %s", peer, out.Error)
+	}
+	p.clearUnreachable(peer)
+	return out.Count, nil
+}
+
+// ServeHTTP lets this process act as the owner for keys hashed to it: it
+// handles Take/Release RPCs forwarded by peer chproxy instances.
+func (p *PeerLimiter) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var rpc rpcRequest
+	if err := json.NewDecoder(r.Body).Decode(&rpc); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	var out rpcResponse
+	switch {
+	case rpc.Release:
+		p.local.Release(rpc.Key)
+	case rpc.Peek:
+		out.Count = p.local.Count(rpc.Key)
+	default:
+		n, err := p.local.Take(r.Context(), rpc.Key)
+		if err != nil {
+			out.Error = err.Error()
+		}
+		out.Count = n
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(out)
+}
+
+func (p *PeerLimiter) markUnreachable(peer string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if _, ok := p.unreachable[peer]; !ok {
+		p.unreachable[peer] = time.Now()
+	}
+}
+
+func (p *PeerLimiter) clearUnreachable(peer string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	delete(p.unreachable, peer)
+}
+
+func (p *PeerLimiter) recentlyUnreachable(peer string) bool {
+	p.mu.Lock()
+	since, ok := p.unreachable[peer]
+	p.mu.Unlock()
+	return ok && time.Since(since) < p.staleTolerance
+}
@@ -0,0 +1,36 @@
+package limiter
+
+import "testing"
+
+// TestHashRingMinimizesChurn checks that removing one peer out of n only
+// remaps roughly 1/n of the keys, as a real consistent-hash ring should,
+// rather than nearly all of them as plain fnv32(key)%len(peers) would.
+func TestHashRingMinimizesChurn(t *testing.T) {
+	before := []string{"peer-a:8080", "peer-b:8080", "peer-c:8080", "peer-d:8080"}
+	after := []string{"peer-a:8080", "peer-b:8080", "peer-c:8080"} // peer-d removed
+
+	ringBefore := newHashRing(before)
+	ringAfter := newHashRing(after)
+
+	const numKeys = 1000
+	moved := 0
+	for i := 0; i < numKeys; i++ {
+		key := "clusteruser:user-" + string(rune('a'+i%26)) + string(rune('0'+i%10))
+		ownerBefore := ringBefore.owner(key)
+		ownerAfter := ringAfter.owner(key)
+		if ownerBefore == "peer-d:8080" {
+			// these keys must move somewhere, that's expected.
+			continue
+		}
+		if ownerBefore != ownerAfter {
+			moved++
+		}
+	}
+
+	// With a real ring, keys that weren't owned by the removed peer should
+	// essentially never move. A plain modulo hash remaps the large majority
+	// of them when len(peers) changes from 4 to 3.
+	if moved > numKeys/20 {
+		t.Errorf("removing one of %d peers moved %d/%d keys that weren't on it; want consistent-hash-level churn (<5%%)", len(before), moved, numKeys)
+	}
+}
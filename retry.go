@@ -0,0 +1,148 @@
+package main
+
+import (
+	"context"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// RetryPolicy configures automatic retries for a cluster. A request is only
+// ever retried if it's provably idempotent -- see (*scope).isRetryable --
+// so MaxRetries of zero (the default) keeps today's fail-fast behavior.
+type RetryPolicy struct {
+	MaxRetries     int
+	InitialBackoff time.Duration
+	MaxBackoff     time.Duration
+	Jitter         time.Duration
+	// RetryOn lists the HTTP status codes (as strings, e.g. "502") and the
+	// network error classes (currently just "network") that are eligible
+	// for retry. An empty list means none are.
+	RetryOn []string
+}
+
+func (rp RetryPolicy) retriesOnStatus(statusCode int) bool {
+	code := strconv.Itoa(statusCode)
+	for _, s := range rp.RetryOn {
+		if s == code {
+			return true
+		}
+	}
+	return false
+}
+
+func (rp RetryPolicy) retriesOnNetworkError() bool {
+	for _, s := range rp.RetryOn {
+		if s == "network" {
+			return true
+		}
+	}
+	return false
+}
+
+// backoff computes the delay before the given retry attempt (0-based),
+// following min(MaxBackoff, InitialBackoff*2^attempt) + rand(Jitter).
+func (rp RetryPolicy) backoff(attempt int) time.Duration {
+	d := rp.InitialBackoff << uint(attempt)
+	if rp.MaxBackoff > 0 && d > rp.MaxBackoff {
+		d = rp.MaxBackoff
+	}
+	if rp.Jitter > 0 {
+		d += time.Duration(rand.Int63n(int64(rp.Jitter)))
+	}
+	return d
+}
+
+// isRetryable reports whether req may be safely replayed against a
+// different host: only a request explicitly marked with
+// X-ClickHouse-Retryable: true, or one whose query param is a plain SELECT,
+// is retryable. Anything else must not be retried, since replaying it could
+// duplicate side effects.
+func (s *scope) isRetryable(req *http.Request) bool {
+	if req.Header.Get("X-ClickHouse-Retryable") == "true" {
+		return true
+	}
+	q := req.URL.Query().Get("query")
+	if q == "" {
+		return false
+	}
+	return isSelectQuery(q)
+}
+
+func isSelectQuery(q string) bool {
+	q = strings.TrimSpace(q)
+	return len(q) >= 6 && strings.EqualFold(q[:6], "select")
+}
+
+// nextQueryID allocates a fresh scope id for a retry attempt, so that a
+// replayed request gets its own query_id and KILL QUERY can't collide with
+// the attempt it's replacing.
+func (s *scope) nextQueryID() {
+	s.id = atomic.AddUint32(&scopeID, 1)
+}
+
+// retryOrFail decides whether a failed attempt against s.host should be
+// retried elsewhere. On a retryable failure it penalizes the failing host,
+// rebinds s to a freshly chosen host with a new query_id, and reports the
+// retry via chproxy_request_retries_total. retriable is typically the
+// result of a prior call to (*scope).isRetryable, cached by the caller so
+// the request isn't re-inspected on every attempt.
+func (s *scope) retryOrFail(ctx context.Context, retriable bool, attempt int, statusCode int, err error) bool {
+	if !retriable || attempt >= s.cluster.retryPolicy.MaxRetries {
+		return false
+	}
+
+	reason := "network"
+	retry := err != nil && s.cluster.retryPolicy.retriesOnNetworkError()
+	if err == nil {
+		reason = strconv.Itoa(statusCode)
+		retry = s.cluster.retryPolicy.retriesOnStatus(statusCode)
+	}
+	if !retry {
+		return false
+	}
+
+	requestRetries.With(prometheus.Labels{
+		"cluster": s.cluster.name,
+		"host":    s.host.addr.Host,
+		"reason":  reason,
+	}).Inc()
+
+	s.host.penalize()
+	// Pick the new host directly via pickLeastLoaded rather than going back
+	// through c.getHost/the configured Scheduler: s already holds its
+	// concurrency slot on cu, so routing a retry through PriorityScheduler
+	// would see cu as saturated by this very attempt and queue it instead of
+	// just failing over to another host.
+	if err := s.cluster.checkMinHealthyHosts(); err != nil {
+		return false
+	}
+	h := s.cluster.pickLeastLoaded()
+	if h == nil {
+		return false
+	}
+	s.host.unregisterScope(s.id)
+	s.clusterUser.unregisterScope(s.id)
+	s.host.dec()
+	s.host = h
+	s.nextQueryID()
+	s.host.registerScope(s)
+	s.clusterUser.registerScope(s)
+	s.host.inc()
+	time.Sleep(s.cluster.retryPolicy.backoff(attempt))
+	return true
+}
+
+var requestRetries = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Name: "chproxy_request_retries_total",
+	Help: "Number of times a request was retried against a different host after a transient failure.",
+}, []string{"cluster", "host", "reason"})
+
+func init() {
+	prometheus.MustRegister(requestRetries)
+}
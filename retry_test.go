@@ -0,0 +1,76 @@
+package main
+
+import (
+	"context"
+	"net/url"
+	"testing"
+	"time"
+)
+
+func mustParseURL(t *testing.T, raw string) *url.URL {
+	t.Helper()
+	u, err := url.Parse(raw)
+	if err != nil {
+		t.Fatalf("error parsing %q: %s", raw, err)
+	}
+	return u
+}
+
+// TestRetryOrFailRebalancesHostCounters checks that a retry releases the old
+// host's counter and takes the new host's, rather than leaking one and
+// wrapping the other.
+func TestRetryOrFailRebalancesHostCounters(t *testing.T) {
+	oldHost := &host{addr: mustParseURL(t, "http://127.0.0.1:8001")}
+	oldHost.setHealthScore(1)
+	newHost := &host{addr: mustParseURL(t, "http://127.0.0.1:8002")}
+	newHost.setHealthScore(1)
+
+	c := &cluster{
+		name:  "test",
+		hosts: []*host{oldHost, newHost},
+		retryPolicy: RetryPolicy{
+			MaxRetries:     1,
+			InitialBackoff: time.Millisecond,
+			MaxBackoff:     time.Millisecond,
+			RetryOn:        []string{"network"},
+		},
+	}
+	u := &user{name: "u"}
+	cu := &clusterUser{name: "cu"}
+
+	s, err := newScope(context.Background(), u, cu, c)
+	if err != nil {
+		t.Fatalf("newScope() error: %s", err)
+	}
+	if err := s.inc(context.Background()); err != nil {
+		t.Fatalf("s.inc() error: %s", err)
+	}
+	defer s.dec()
+
+	originalHost := s.host
+	if got := originalHost.queryCounter.runningQueries(); got != 1 {
+		t.Fatalf("queryCounter on original host = %d, want 1", got)
+	}
+
+	if !s.retryOrFail(context.Background(), true, 0, 0, errConnRefusedForTest) {
+		t.Fatalf("retryOrFail() = false, want true")
+	}
+
+	// The original host's in-flight counter must be released, not left
+	// permanently inflated.
+	if got := originalHost.queryCounter.runningQueries(); got != 0 {
+		t.Errorf("queryCounter on original host after retry = %d, want 0 (leaked counter)", got)
+	}
+	// The new host's counter must reflect the scope that moved to it, not
+	// stay at 0 (which scope.dec's deferred decrement would then wrap to
+	// ~4.29 billion).
+	if got := s.host.queryCounter.runningQueries(); got != 1 {
+		t.Errorf("queryCounter on new host after retry = %d, want 1 (never incremented)", got)
+	}
+}
+
+var errConnRefusedForTest = &dummyNetError{}
+
+type dummyNetError struct{}
+
+func (*dummyNetError) Error() string { return "connection refused" }
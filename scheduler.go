@@ -0,0 +1,205 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/Vertamedia/chproxy/config"
+	"github.com/Vertamedia/chproxy/log"
+)
+
+// Scheduler picks the host a new scope for u/cu should run on. Implementations
+// may block (e.g. to queue a low-priority request) as long as they respect ctx.
+type Scheduler interface {
+	Schedule(ctx context.Context, c *cluster, u *user, cu *clusterUser) (*host, error)
+}
+
+// scheduleNotifier is implemented by schedulers that need to know when a
+// scope finishes, e.g. to wake up a queued waiter. It's optional: scope.dec
+// type-asserts for it instead of adding a no-op method to every Scheduler.
+type scheduleNotifier interface {
+	release(cu *clusterUser)
+}
+
+// leastLoadedScheduler is today's behavior: round-robin plus least (weighted)
+// load, with no queueing or preemption. It's the zero-value default.
+type leastLoadedScheduler struct{}
+
+func (leastLoadedScheduler) Schedule(_ context.Context, c *cluster, _ *user, _ *clusterUser) (*host, error) {
+	h := c.pickLeastLoaded()
+	if h == nil {
+		return nil, fmt.Errorf("no active hosts")
+	}
+	return h, nil
+}
+
+const defaultQueueTimeout = 30 * time.Second
+
+// priorityRank orders priorities from least to most eligible to jump the
+// queue or preempt another scope.
+func priorityRank(p config.Priority) int {
+	switch p {
+	case config.PriorityInteractive:
+		return 2
+	case config.PriorityBatch:
+		return 1
+	default:
+		return 0
+	}
+}
+
+// PriorityScheduler replaces plain FCFS admission with a per-cluster-user
+// bounded FIFO: once a clusterUser hits maxConcurrentQueries, new requests
+// wait in priority order (higher priority jumps ahead of lower) for up to
+// queue_timeout. An interactive requester first preempts (kills) an
+// in-flight lower-priority scope on the same clusterUser, if there is one,
+// and then waits in the queue like any other request.
+type PriorityScheduler struct {
+	mu     sync.Mutex
+	queues map[string]*waiterQueue
+}
+
+// NewPriorityScheduler returns a ready-to-use PriorityScheduler.
+func NewPriorityScheduler() *PriorityScheduler {
+	return &PriorityScheduler{queues: make(map[string]*waiterQueue)}
+}
+
+func (ps *PriorityScheduler) queueFor(name string) *waiterQueue {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	q, ok := ps.queues[name]
+	if !ok {
+		q = &waiterQueue{}
+		ps.queues[name] = q
+	}
+	return q
+}
+
+func (ps *PriorityScheduler) Schedule(ctx context.Context, c *cluster, u *user, cu *clusterUser) (*host, error) {
+	if cu.maxConcurrentQueries == 0 || cu.runningQueries() < cu.maxConcurrentQueries {
+		h := c.pickLeastLoaded()
+		if h == nil {
+			return nil, fmt.Errorf("no active hosts")
+		}
+		return h, nil
+	}
+
+	if u.priority == config.PriorityInteractive {
+		if victim := pickPreemptionVictim(cu, u.priority); victim != nil {
+			log.Debugf("preempting scope %d (user %q) to admit higher-priority request from user %q", victim.id, victim.user.name, u.name)
+			if err := victim.killQuery(); err != nil {
+				log.Errorf("error preempting scope %d: %s", victim.id, err)
+			}
+		}
+	}
+
+	q := ps.queueFor(cu.name)
+	done := make(chan struct{})
+	w := q.enqueue(u.priority, done)
+	defer q.remove(w)
+
+	timeout := cu.queueTimeout
+	if timeout <= 0 {
+		timeout = defaultQueueTimeout
+	}
+	waitCtx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	for {
+		if q.front() == w && cu.runningQueries() < cu.maxConcurrentQueries {
+			h := c.pickLeastLoaded()
+			if h == nil {
+				return nil, fmt.Errorf("no active hosts")
+			}
+			return h, nil
+		}
+		select {
+		case <-waitCtx.Done():
+			return nil, fmt.Errorf("request for cluster user %q timed out waiting in the scheduling queue", cu.name)
+		case <-done:
+		case <-time.After(20 * time.Millisecond):
+		}
+	}
+}
+
+// release wakes up waiters for cu now that a slot has freed.
+func (ps *PriorityScheduler) release(cu *clusterUser) {
+	ps.queueFor(cu.name).wake()
+}
+
+func pickPreemptionVictim(cu *clusterUser, requesterPriority config.Priority) *scope {
+	var victim *scope
+	victimRank := priorityRank(requesterPriority)
+	for _, s := range cu.snapshotScopes() {
+		rank := priorityRank(s.user.priority)
+		if rank < victimRank {
+			victim, victimRank = s, rank
+		}
+	}
+	return victim
+}
+
+// waiter is a single request parked in a waiterQueue.
+type waiter struct {
+	priority config.Priority
+	done     chan struct{}
+}
+
+// waiterQueue is a per-cluster-user FIFO where enqueue() inserts ahead of
+// any lower-priority waiter already parked, so higher priorities skip ahead
+// without starving same-priority requests that arrived earlier.
+type waiterQueue struct {
+	mu      sync.Mutex
+	waiting []*waiter
+}
+
+func (q *waiterQueue) enqueue(priority config.Priority, done chan struct{}) *waiter {
+	w := &waiter{priority: priority, done: done}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	idx := len(q.waiting)
+	for i, existing := range q.waiting {
+		if priorityRank(priority) > priorityRank(existing.priority) {
+			idx = i
+			break
+		}
+	}
+	q.waiting = append(q.waiting, nil)
+	copy(q.waiting[idx+1:], q.waiting[idx:])
+	q.waiting[idx] = w
+	return w
+}
+
+func (q *waiterQueue) remove(w *waiter) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for i, existing := range q.waiting {
+		if existing == w {
+			q.waiting = append(q.waiting[:i], q.waiting[i+1:]...)
+			return
+		}
+	}
+}
+
+func (q *waiterQueue) front() *waiter {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if len(q.waiting) == 0 {
+		return nil
+	}
+	return q.waiting[0]
+}
+
+func (q *waiterQueue) wake() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if len(q.waiting) == 0 {
+		return
+	}
+	select {
+	case q.waiting[0].done <- struct{}{}:
+	default:
+	}
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/Vertamedia/chproxy/config"
+)
+
+// TestWaiterQueueOrdersByPriority checks that a higher-priority waiter jumps
+// ahead of lower-priority waiters already parked, while same-priority
+// waiters keep arrival order.
+func TestWaiterQueueOrdersByPriority(t *testing.T) {
+	q := &waiterQueue{}
+
+	batch1 := q.enqueue(config.PriorityBatch, make(chan struct{}, 1))
+	batch2 := q.enqueue(config.PriorityBatch, make(chan struct{}, 1))
+
+	if front := q.front(); front != batch1 {
+		t.Fatalf("front() before interactive waiter arrived = %p, want batch1 (%p)", front, batch1)
+	}
+
+	interactive := q.enqueue(config.PriorityInteractive, make(chan struct{}, 1))
+
+	// interactive jumped ahead of both batch waiters, but batch1 still
+	// precedes batch2 since they arrived in that order.
+	if front := q.front(); front != interactive {
+		t.Fatalf("front() after interactive waiter arrived = %p, want interactive (%p)", front, interactive)
+	}
+	q.remove(interactive)
+	if front := q.front(); front != batch1 {
+		t.Fatalf("front() after removing interactive = %p, want batch1 (%p)", front, batch1)
+	}
+	q.remove(batch1)
+	if front := q.front(); front != batch2 {
+		t.Fatalf("front() after removing batch1 = %p, want batch2 (%p)", front, batch2)
+	}
+}
+
+// TestPickPreemptionVictimPicksLowestPriority checks that preemption targets
+// the lowest-priority in-flight scope, not an arbitrary one.
+func TestPickPreemptionVictimPicksLowestPriority(t *testing.T) {
+	cu := &clusterUser{name: "cu"}
+
+	background := &scope{id: 1, user: &user{name: "background"}}
+	batch := &scope{id: 2, user: &user{name: "batch", priority: config.PriorityBatch}}
+	interactive := &scope{id: 3, user: &user{name: "interactive", priority: config.PriorityInteractive}}
+
+	cu.registerScope(background)
+	cu.registerScope(batch)
+	cu.registerScope(interactive)
+
+	victim := pickPreemptionVictim(cu, config.PriorityInteractive)
+	if victim != background {
+		t.Fatalf("pickPreemptionVictim() = %v, want the background-priority scope", victim.user.name)
+	}
+}
+
+// TestPickPreemptionVictimNoneLowerThanRequester checks that a requester
+// never preempts a scope at or above its own priority.
+func TestPickPreemptionVictimNoneLowerThanRequester(t *testing.T) {
+	cu := &clusterUser{name: "cu"}
+
+	batch := &scope{id: 1, user: &user{name: "batch", priority: config.PriorityBatch}}
+	interactive := &scope{id: 2, user: &user{name: "interactive", priority: config.PriorityInteractive}}
+	cu.registerScope(batch)
+	cu.registerScope(interactive)
+
+	if victim := pickPreemptionVictim(cu, config.PriorityBatch); victim != nil {
+		t.Fatalf("pickPreemptionVictim() = %v, want nil (nothing lower priority than batch)", victim.user.name)
+	}
+}
@@ -4,19 +4,28 @@ import (
 	"context"
 	"fmt"
 	"io/ioutil"
+	"math"
 	"net/http"
 	"net/url"
 	"strconv"
 	"strings"
+	"sync"
 	"sync/atomic"
 	"time"
 
 	"github.com/Vertamedia/chproxy/config"
+	"github.com/Vertamedia/chproxy/limiter"
 	"github.com/Vertamedia/chproxy/log"
 	"github.com/prometheus/client_golang/prometheus"
+	"golang.org/x/time/rate"
 	"net"
 )
 
+// defaultLimiter backs every user/clusterUser that isn't explicitly wired to
+// a distributed limiter.Limiter, so the common single-replica case keeps
+// behaving exactly like the old in-process queryCounter.
+var defaultLimiter = limiter.NewLocal()
+
 func (s *scope) String() string {
 	return fmt.Sprintf("[ Id: %d; User %q(%d) proxying as %q(%d) to %q(%d) ]",
 		s.id,
@@ -35,26 +44,74 @@ type scope struct {
 
 var scopeID = uint32(time.Now().UnixNano())
 
-func newScope(u *user, cu *clusterUser, c *cluster) (*scope, error) {
-	h := c.getHost()
-	if h == nil {
-		return nil, fmt.Errorf("no active hosts")
+func newScope(ctx context.Context, u *user, cu *clusterUser, c *cluster) (*scope, error) {
+	if err := admitScope(); err != nil {
+		return nil, err
+	}
+	h, err := c.getHost(ctx, u, cu)
+	if err != nil {
+		releaseScope()
+		return nil, err
 	}
-	return &scope{
+	s := &scope{
 		id:          atomic.AddUint32(&scopeID, 1),
 		host:        h,
 		cluster:     c,
 		user:        u,
 		clusterUser: cu,
-	}, nil
+	}
+	h.registerScope(s)
+	cu.registerScope(s)
+	return s, nil
 }
 
-func (s *scope) inc() error {
-	uq := s.user.inc()
-	cq := s.clusterUser.inc()
+// errRateLimited is returned by inc() whenever a user or cluster user is
+// over its requests_per_second limit and is configured to fail fast
+// instead of waiting. The caller maps it onto an HTTP 429 response.
+var errRateLimited = fmt.Errorf("rate limit exceeded")
+
+var rateLimited = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Name: "chproxy_rate_limited_total",
+	Help: "Number of requests throttled or rejected by the requests_per_second limiter.",
+}, []string{"user"})
+
+func init() {
+	prometheus.MustRegister(rateLimited)
+}
+
+// inc self-unwinds newScope's reservation on every error return; callers
+// only defer s.dec() once inc() has succeeded.
+func (s *scope) inc(ctx context.Context) error {
+	if s.user.maxExecutionTime > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, s.user.maxExecutionTime)
+		defer cancel()
+	}
+
+	if err := s.user.rateLimiter.wait(ctx); err != nil {
+		rateLimited.With(prometheus.Labels{"user": s.user.name}).Inc()
+		s.unregister()
+		return err
+	}
+	if err := s.clusterUser.rateLimiter.wait(ctx); err != nil {
+		rateLimited.With(prometheus.Labels{"user": s.clusterUser.name}).Inc()
+		s.unregister()
+		return err
+	}
+
+	uq, err := s.user.inc(ctx)
+	if err != nil {
+		s.unregister()
+		return fmt.Errorf("error while limiting user %q: %s", s.user.name, err)
+	}
+	cq, err := s.clusterUser.inc(ctx)
+	if err != nil {
+		s.user.dec()
+		s.unregister()
+		return fmt.Errorf("error while limiting cluster user %q: %s", s.clusterUser.name, err)
+	}
 	s.host.inc()
 
-	var err error
 	if s.user.maxConcurrentQueries > 0 && uq > s.user.maxConcurrentQueries {
 		err = fmt.Errorf("limits for user %q are exceeded: maxConcurrentQueries limit: %d", s.user.name, s.user.maxConcurrentQueries)
 	}
@@ -68,10 +125,22 @@ func (s *scope) inc() error {
 	return nil
 }
 
+// unregister undoes newScope's registry and watermark bookkeeping for s.
+// Every error path out of inc(), and every dec(), must call it exactly once.
+func (s *scope) unregister() {
+	s.host.unregisterScope(s.id)
+	s.clusterUser.unregisterScope(s.id)
+	releaseScope()
+}
+
 func (s *scope) dec() {
+	s.unregister()
 	s.host.dec()
 	s.user.dec()
 	s.clusterUser.dec()
+	if notifier, ok := s.cluster.scheduler.(scheduleNotifier); ok {
+		notifier.release(s.clusterUser)
+	}
 }
 
 const killQueryTimeout = time.Second * 30
@@ -157,44 +226,171 @@ type user struct {
 	name, password       string
 	maxExecutionTime     time.Duration
 	maxConcurrentQueries uint32
-
-	queryCounter
+	// priority controls queue position and preemption rights when the
+	// shared clusterUser is saturated; see scheduler.go.
+	priority config.Priority
+
+	rateLimiter
+	// concurrency tracks in-flight requests for this user. It's nil for
+	// users built the old way (plain struct literal), in which case
+	// defaultLimiter is used -- see concurrencyLimiter().
+	concurrency limiter.Limiter
 }
 
 type clusterUser struct {
 	name, password       string
 	maxExecutionTime     time.Duration
 	maxConcurrentQueries uint32
+	// queueTimeout bounds how long a request waits in the priority queue
+	// (see scheduler.go) once maxConcurrentQueries is reached. Zero means
+	// the scheduler's default is used.
+	queueTimeout time.Duration
+
+	rateLimiter
+	concurrency limiter.Limiter
+
+	// scopesMu guards runningScopes, used by PriorityScheduler to find a
+	// lower-priority scope to preempt when this clusterUser is saturated.
+	scopesMu      sync.Mutex
+	runningScopes map[uint32]*scope
+}
 
-	queryCounter
+func (cu *clusterUser) registerScope(s *scope) {
+	cu.scopesMu.Lock()
+	if cu.runningScopes == nil {
+		cu.runningScopes = make(map[uint32]*scope)
+	}
+	cu.runningScopes[s.id] = s
+	cu.scopesMu.Unlock()
+}
+
+func (cu *clusterUser) unregisterScope(id uint32) {
+	cu.scopesMu.Lock()
+	delete(cu.runningScopes, id)
+	cu.scopesMu.Unlock()
+}
+
+func (cu *clusterUser) snapshotScopes() []*scope {
+	cu.scopesMu.Lock()
+	defer cu.scopesMu.Unlock()
+	out := make([]*scope, 0, len(cu.runningScopes))
+	for _, s := range cu.runningScopes {
+		out = append(out, s)
+	}
+	return out
+}
+
+func (u *user) concurrencyLimiter() limiter.Limiter {
+	if u.concurrency != nil {
+		return u.concurrency
+	}
+	return defaultLimiter
+}
+
+func (u *user) concurrencyKey() string { return "user:" + u.name }
+
+func (u *user) inc(ctx context.Context) (uint32, error) {
+	return u.concurrencyLimiter().Take(ctx, u.concurrencyKey())
+}
+
+func (u *user) dec() { u.concurrencyLimiter().Release(u.concurrencyKey()) }
+
+func (u *user) runningQueries() uint32 { return u.concurrencyLimiter().Count(u.concurrencyKey()) }
+
+func (cu *clusterUser) concurrencyLimiter() limiter.Limiter {
+	if cu.concurrency != nil {
+		return cu.concurrency
+	}
+	return defaultLimiter
+}
+
+func (cu *clusterUser) concurrencyKey() string { return "clusteruser:" + cu.name }
+
+func (cu *clusterUser) inc(ctx context.Context) (uint32, error) {
+	return cu.concurrencyLimiter().Take(ctx, cu.concurrencyKey())
+}
+
+func (cu *clusterUser) dec() { cu.concurrencyLimiter().Release(cu.concurrencyKey()) }
+
+func (cu *clusterUser) runningQueries() uint32 {
+	return cu.concurrencyLimiter().Count(cu.concurrencyKey())
+}
+
+// rateLimiter throttles requests for a user or clusterUser at a configured
+// requests-per-second rate. A zero rateLimiter (limiter == nil) imposes no
+// limit, which keeps it safe to embed in structs built without RPS configured.
+type rateLimiter struct {
+	limiter *rate.Limiter
+	mode    config.RateMode
+}
+
+func newRateLimiter(rps float64, burst int, mode config.RateMode) rateLimiter {
+	if rps <= 0 {
+		return rateLimiter{}
+	}
+	if burst <= 0 {
+		burst = 1
+	}
+	return rateLimiter{
+		limiter: rate.NewLimiter(rate.Limit(rps), burst),
+		mode:    mode,
+	}
+}
+
+// wait blocks until the limiter admits the request, unless mode is
+// config.RateModeReject, in which case it fails fast with errRateLimited
+// instead of waiting for a free slot.
+func (rl rateLimiter) wait(ctx context.Context) error {
+	if rl.limiter == nil {
+		return nil
+	}
+	if rl.mode == config.RateModeReject {
+		if !rl.limiter.Allow() {
+			return errRateLimited
+		}
+		return nil
+	}
+	if err := rl.limiter.Wait(ctx); err != nil {
+		return errRateLimited
+	}
+	return nil
 }
 
 type host struct {
 	// counter of unsuccessful requests to decrease
 	// host priority
 	penalty uint32
-	// if equal to 0 then wouldn't be returned from getHost()
-	active uint32
+	// healthScoreBits is a float64, accessed via math.Float64bits/frombits
+	// since there's no atomic float type. 0 means dead/not yet probed; see
+	// health.go for how it's produced and (*host).load for how it's used.
+	healthScoreBits uint64
+	// if equal to 1 then the host is draining and wouldn't be returned
+	// from getHost(); see Drain in drain.go
+	draining uint32
+	// weight biases weighted round-robin towards larger nodes and scales
+	// how heavily a degraded healthScore counts against a host; 0 is
+	// treated as 1, so existing configs without a weight are unaffected.
+	weight uint32
 	// host address
 	addr *url.URL
 
+	// scopesMu guards runningScopes, the registry Drain uses to find and
+	// kill straggler scopes once its timeout elapses.
+	scopesMu      sync.Mutex
+	runningScopes map[uint32]*scope
+
 	queryCounter
 }
 
-func (h *host) runHeartbeat(interval time.Duration, cluster string, done <-chan struct{}) {
+func (h *host) runHeartbeat(interval time.Duration, cluster string, probes []HealthProbe, done <-chan struct{}) {
 	label := prometheus.Labels{
 		"cluster": cluster,
 		"host":    h.addr.Host,
 	}
 	heartbeat := func() {
-		if err := isHealthy(h.addr.String()); err == nil {
-			atomic.StoreUint32(&h.active, uint32(1))
-			hostHealth.With(label).Set(1)
-		} else {
-			log.Errorf("error while health-checking %q host: %s", h.addr.Host, err)
-			atomic.StoreUint32(&h.active, uint32(0))
-			hostHealth.With(label).Set(0)
-		}
+		score := runHealthProbes(probes, h.addr, cluster, h.addr.Host)
+		h.setHealthScore(score)
+		hostHealth.With(label).Set(score)
 	}
 	heartbeat()
 	for {
@@ -207,8 +403,19 @@ func (h *host) runHeartbeat(interval time.Duration, cluster string, done <-chan
 	}
 }
 
+func (h *host) setHealthScore(score float64) {
+	atomic.StoreUint64(&h.healthScoreBits, math.Float64bits(score))
+}
+
+func (h *host) healthScore() float64 {
+	return math.Float64frombits(atomic.LoadUint64(&h.healthScoreBits))
+}
+
+// isActive reports whether h may be returned from getHost() at all: it's
+// not draining and at least minimally healthy. Degraded-but-alive hosts
+// stay active and are down-weighted instead -- see (*host).load.
 func (h *host) isActive() bool {
-	return atomic.LoadUint32(&h.active) == 1
+	return h.healthScore() > 0 && !h.isDraining()
 }
 
 const (
@@ -240,25 +447,73 @@ func (h *host) runningQueries() uint32 {
 }
 
 type cluster struct {
+	name                  string
 	nextIdx               uint32
 	hosts                 []*host
 	users                 map[string]*clusterUser
 	killQueryUserName     string
 	killQueryUserPassword string
 	heartBeatInterval     time.Duration
+	retryPolicy           RetryPolicy
+	// scheduler picks a host (and, for schedulers that support it, queues
+	// or preempts) for each new scope. Nil falls back to leastLoadedScheduler,
+	// i.e. today's round-robin + least-loaded behavior. See scheduler.go.
+	scheduler Scheduler
+	// healthProbes configures runHeartbeat; nil means SelectOneProbe only.
+	healthProbes []HealthProbe
+	// minHealthyHosts, if non-zero, makes getHost fail fast instead of
+	// serving traffic once fewer than this many hosts are active.
+	minHealthyHosts int
+}
+
+// getHost picks a host for a new scope belonging to u/cu, delegating to
+// c.scheduler.
+func (c *cluster) getHost(ctx context.Context, u *user, cu *clusterUser) (*host, error) {
+	if err := c.checkMinHealthyHosts(); err != nil {
+		return nil, err
+	}
+	sched := c.scheduler
+	if sched == nil {
+		sched = leastLoadedScheduler{}
+	}
+	return sched.Schedule(ctx, c, u, cu)
+}
+
+// checkMinHealthyHosts fails fast with an error instead of letting getHost
+// serve traffic once too few replicas are passing their health probes.
+func (c *cluster) checkMinHealthyHosts() error {
+	if c.minHealthyHosts == 0 {
+		return nil
+	}
+	healthy := 0
+	for _, h := range c.hosts {
+		if h.isActive() {
+			healthy++
+		}
+	}
+	if healthy < c.minHealthyHosts {
+		return fmt.Errorf("cluster %q has only %d healthy hosts, below min_healthy_hosts=%d", c.name, healthy, c.minHealthyHosts)
+	}
+	return nil
 }
 
-// get least loaded + round-robin host from cluster
-func (c *cluster) getHost() *host {
+// pickLeastLoaded returns the least loaded active, non-draining host using
+// round-robin + weighted load, or nil if none qualify. It's the host-choice
+// primitive every Scheduler implementation is built on.
+func (c *cluster) pickLeastLoaded() *host {
 	idx := atomic.AddUint32(&c.nextIdx, 1)
 	l := uint32(len(c.hosts))
 	idx = idx % l
 	idle := c.hosts[idx]
-	idleN := idle.runningQueries()
+	idleLoad := idle.load()
 
-	if idleN == 0 && idle.isActive() {
+	if idleLoad == 0 && idle.isActive() {
 		return idle
 	}
+	if !idle.isActive() {
+		// any active host beats an inactive starting point, whatever its load
+		idleLoad = math.Inf(1)
+	}
 
 	// round hosts checking
 	// until the least loaded is found
@@ -267,12 +522,12 @@ func (c *cluster) getHost() *host {
 		if !h.isActive() {
 			continue
 		}
-		n := h.runningQueries()
-		if n == 0 {
+		load := h.load()
+		if load == 0 {
 			return h
 		}
-		if n < idleN {
-			idle, idleN = h, n
+		if load < idleLoad {
+			idle, idleLoad = h, load
 		}
 	}
 	if !idle.isActive() {
@@ -281,6 +536,22 @@ func (c *cluster) getHost() *host {
 	return idle
 }
 
+// load combines running queries, accumulated penalty and health into a
+// single score getHost minimizes: (runningQueries+penalty)/weight biases
+// weighted round-robin towards larger nodes, and weight*(1-healthScore)
+// down-weights a degraded-but-alive replica in proportion to its own
+// capacity instead of excluding it outright.
+func (h *host) load() float64 {
+	w := h.weight
+	if w == 0 {
+		w = 1
+	}
+	raw := float64(h.queryCounter.runningQueries())
+	penalty := float64(atomic.LoadUint32(&h.penalty))
+	degradation := float64(w) * (1 - h.healthScore())
+	return (raw+penalty)/float64(w) + degradation
+}
+
 type queryCounter struct {
 	value uint32
 }